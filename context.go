@@ -0,0 +1,18 @@
+package session
+
+import (
+	"context"
+)
+
+type sessionContextKey struct{}
+
+// 将Session存入ctx，可配合http.Request.WithContext在中间件与handler间传递
+func ContextWithSession(ctx context.Context, s Session) context.Context {
+	return context.WithValue(ctx, sessionContextKey{}, s)
+}
+
+// 取出ContextWithSession存入的Session，ctx中没有Session时ok为false
+func SessionFromContext(ctx context.Context) (Session, bool) {
+	s, ok := ctx.Value(sessionContextKey{}).(Session)
+	return s, ok
+}
@@ -0,0 +1,59 @@
+package session
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// 仅用于测试的Session实现，所有请求共享同一份数据
+type testSession struct {
+	data map[string]interface{}
+}
+
+func (s *testSession) Get(http.ResponseWriter, *http.Request) map[string]interface{} {
+	return s.data
+}
+
+func (s *testSession) Set(session map[string]interface{}, rw http.ResponseWriter, req *http.Request) {
+	s.data = session
+}
+
+func (s *testSession) SetCookieExpires(session map[string]interface{}, cookieExpires int) {
+	session["__cookieExpires"] = cookieExpires
+}
+
+func withSession(s Session, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(rw, req.WithContext(ContextWithSession(req.Context(), s)))
+	})
+}
+
+func TestSessionFromContext(t *testing.T) {
+	sm := &testSession{}
+
+	var ok bool
+	handler := withSession(sm, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var s Session
+		if s, ok = SessionFromContext(req.Context()); ok {
+			s.Set(map[string]interface{}{"uid": "1"}, rw, req)
+		}
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if !ok {
+		t.Fatal("SessionFromContext found no session in the handler")
+	}
+
+	if sm.data["uid"] != "1" {
+		t.Errorf("session written via context = %v, want uid 1", sm.data)
+	}
+}
+
+func TestSessionFromContextMissing(t *testing.T) {
+	if s, ok := SessionFromContext(context.Background()); ok || s != nil {
+		t.Errorf("SessionFromContext = %v, %v; want nil, false", s, ok)
+	}
+}
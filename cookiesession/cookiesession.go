@@ -15,14 +15,26 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"github.com/haiyiyun/log"
-	"github.com/haiyiyun/utils/help"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"io"
 	"net/http"
 	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidCookie  = errors.New("cookiesession: invalid cookie")
+	ErrCookieTampered = errors.New("cookiesession: cookie hmac mismatch")
 )
 
 func init() {
@@ -94,12 +106,19 @@ func decodeCookie(encodedCookie string, key, iv []byte) (map[string]interface{},
 		return nil, err
 	}
 
+	if len(sessionBytes) == 0 || len(sessionBytes)%aes.BlockSize != 0 {
+		return nil, ErrInvalidCookie
+	}
+
 	decrypter := cipher.NewCBCDecrypter(aesCipher, iv)
 	decrypter.CryptBlocks(sessionBytes, sessionBytes)
 
 	buf := bytes.NewBuffer(sessionBytes)
 	var gobLen int32
 	binary.Read(buf, binary.BigEndian, &gobLen)
+	if gobLen < 0 || int(gobLen) > len(sessionBytes)-4 {
+		return nil, ErrInvalidCookie
+	}
 	gobBytes := sessionBytes[4 : 4+gobLen]
 	session, err := decodeGob(gobBytes)
 	if err != nil {
@@ -109,14 +128,123 @@ func decodeCookie(encodedCookie string, key, iv []byte) (map[string]interface{},
 	return session, nil
 }
 
+// 每次编码随机生成nonce，并置于密文之前
+func encodeAEADCookie(content map[string]interface{}, aead cipher.AEAD) (string, error) {
+	sessionGob, err := encodeGob(content)
+	if err != nil {
+		log.Error("<encodeAEADCookie> ", err)
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(sessionGob)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sessionBytes := aead.Seal(nonce, nonce, []byte(sessionGob), nil)
+	return base64.URLEncoding.EncodeToString(sessionBytes), nil
+}
+
+func decodeAEADCookie(encodedCookie string, aead cipher.AEAD) (map[string]interface{}, error) {
+	sessionBytes, err := base64.URLEncoding.DecodeString(encodedCookie)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := aead.NonceSize()
+	if len(sessionBytes) < nonceSize+aead.Overhead() {
+		return nil, ErrInvalidCookie
+	}
+
+	gobBytes, err := aead.Open(nil, sessionBytes[:nonceSize], sessionBytes[nonceSize:], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeGob(gobBytes)
+}
+
+// 由同一个key推导出的AES-CBC密钥，以及启用ChaCha20-Poly1305时的AEAD
+type cookieKey struct {
+	key  []byte
+	iv   []byte
+	aead cipher.AEAD
+}
+
+func newCookieKey(key []byte, chacha bool) cookieKey {
+	keySha1 := sha1.New()
+	keySha1.Write(key)
+	sum := keySha1.Sum(nil)
+	ck := cookieKey{
+		key: sum[:16],
+		iv:  sum[4:],
+	}
+
+	if chacha {
+		sum := sha256.Sum256(key)
+		ck.aead, _ = chacha20poly1305.New(sum[:])
+	}
+
+	return ck
+}
+
 type SessionManager struct {
 	CookieName   string
 	CookieDomain string
-	key          []byte
-	iv           []byte
+	keys         []cookieKey
+	chacha       bool
+	noCBC        bool
+	macKey       []byte
+}
+
+type Option func(*SessionManager)
+
+// 在cookie值后追加HMAC-SHA256签名(value.hmac)，解密前先校验签名，不匹配时返回ErrCookieTampered
+// 签名密钥由authKey经HKDF推导，与加密密钥互不相关
+// 注意：启用前签发的未签名cookie会校验失败并被视为无session，所有已登录用户都需要重新登录
+func WithHMAC(authKey []byte) Option {
+	return func(s *SessionManager) {
+		s.macKey = make([]byte, sha256.Size)
+		io.ReadFull(hkdf.New(sha256.New, authKey, nil, []byte("haiyiyun cookiesession hmac")), s.macKey)
+	}
+}
+
+// 轮换加密密钥：keys[0]为当前密钥，其余为旧密钥，将替代New中传入的key
+// 以旧密钥解密成功的cookie会在下次Set、GetAndSet或Touch时以keys[0]重新加密并下发
+// Get无法写响应，只负责读取，不会升级cookie
+func WithKeyRotation(keys [][]byte) Option {
+	return func(s *SessionManager) {
+		if len(keys) == 0 {
+			return
+		}
+
+		s.keys = make([]cookieKey, 0, len(keys))
+		for _, key := range keys {
+			s.keys = append(s.keys, newCookieKey(key, s.chacha))
+		}
+	}
+}
+
+// 配合NewWithChaCha20使用，不再回退解密未认证的AES-CBC cookie
+// 应在已签发的cookie都升级为ChaCha20-Poly1305后启用，此后仍为AES-CBC的cookie被视为无session
+func WithoutCBCFallback() Option {
+	return func(s *SessionManager) {
+		s.noCBC = true
+	}
+}
+
+func New(cookieName, key, cookieDomain string, opts ...Option) *SessionManager {
+	return newSessionManager(cookieName, key, cookieDomain, false, opts)
 }
 
-func New(cookieName, key, cookieDomain string) *SessionManager {
+// 使用ChaCha20-Poly1305加密cookie，key经sha256后作为密钥
+// 读取时仍兼容New创建的AES-CBC cookie，并在下次写cookie时升级为ChaCha20-Poly1305
+// 兼容期间AES-CBC解密路径未经认证，仅同时启用WithHMAC时才能防止篡改；升级完成后应启用WithoutCBCFallback
+func NewWithChaCha20(cookieName, key, cookieDomain string, opts ...Option) *SessionManager {
+	return newSessionManager(cookieName, key, cookieDomain, true, opts)
+}
+
+func newSessionManager(cookieName, key, cookieDomain string, chacha bool, opts []Option) *SessionManager {
 	if cookieName == "" {
 		cookieName = "HaiyiyunCookieSession"
 	}
@@ -125,15 +253,71 @@ func New(cookieName, key, cookieDomain string) *SessionManager {
 		key = "Haiyiyun Support CookieSession"
 	}
 
-	keySha1 := sha1.New()
-	keySha1.Write([]byte(key))
-	sum := keySha1.Sum(nil)
-	return &SessionManager{
+	s := &SessionManager{
 		CookieName:   cookieName,
 		CookieDomain: cookieDomain,
-		key:          sum[:16],
-		iv:           sum[4:],
+		keys:         []cookieKey{newCookieKey([]byte(key), chacha)},
+		chacha:       chacha,
 	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+func (s *SessionManager) encodeCookie(session map[string]interface{}) (encoded string, err error) {
+	if k := s.keys[0]; k.aead != nil {
+		encoded, err = encodeAEADCookie(session, k.aead)
+	} else {
+		encoded, err = encodeCookie(session, k.key, k.iv)
+	}
+
+	if err == nil && s.macKey != nil {
+		encoded += "." + s.sign(encoded)
+	}
+
+	return
+}
+
+func (s *SessionManager) sign(value string) string {
+	mac := hmac.New(sha256.New, s.macKey)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// stale为true表示cookie是以旧密钥或AES-CBC加密的，需要以当前密钥重新加密
+func (s *SessionManager) decodeCookie(encodedCookie string) (session map[string]interface{}, stale bool, err error) {
+	if s.macKey != nil {
+		i := strings.LastIndexByte(encodedCookie, '.')
+		if i < 0 || !hmac.Equal([]byte(encodedCookie[i+1:]), []byte(s.sign(encodedCookie[:i]))) {
+			err = ErrCookieTampered
+			return
+		}
+
+		encodedCookie = encodedCookie[:i]
+	}
+
+	for i, k := range s.keys {
+		if k.aead != nil {
+			if session, err = decodeAEADCookie(encodedCookie, k.aead); err == nil {
+				stale = i > 0
+				return
+			}
+
+			if s.noCBC {
+				continue
+			}
+		}
+
+		if session, err = decodeCookie(encodedCookie, k.key, k.iv); err == nil {
+			stale = i > 0 || k.aead != nil
+			return
+		}
+	}
+
+	return
 }
 
 func (s *SessionManager) SetCookieExpires(session map[string]interface{}, cookieExpires int) {
@@ -145,7 +329,7 @@ func (s *SessionManager) Get(req *http.Request) map[string]interface{} {
 	if err != nil {
 		return map[string]interface{}{}
 	}
-	session, err := decodeCookie(cookie.Value, s.key, s.iv)
+	session, _, err := s.decodeCookie(cookie.Value)
 	if err != nil {
 		return map[string]interface{}{}
 	}
@@ -153,7 +337,51 @@ func (s *SessionManager) Get(req *http.Request) map[string]interface{} {
 	return session
 }
 
+// 不改变session数据，重新下发cookie以延长浏览器端的过期时间
+// 未通过SetCookieExpires设置过期时间的cookie是浏览器会话cookie，没有可延长的过期时间，此时返回false
+func (s *SessionManager) Touch(rw http.ResponseWriter, req *http.Request) bool {
+	cookie, err := req.Cookie(s.CookieName)
+	if err != nil {
+		return false
+	}
+
+	session, stale, err := s.decodeCookie(cookie.Value)
+	if err != nil || len(session) == 0 {
+		return false
+	}
+
+	cookieExpires, _ := session["__cookieExpires"].(int)
+	if cookieExpires <= 0 {
+		return false
+	}
+
+	value := cookie.Value
+	if stale {
+		if value, err = s.encodeCookie(session); err != nil {
+			return false
+		}
+	}
+
+	s.setCookie(rw, value, cookieExpires)
+
+	return true
+}
+
 func (s *SessionManager) Set(session map[string]interface{}, rw http.ResponseWriter, req *http.Request) {
+	s.set(session, rw, req)
+}
+
+// 读取session交由fn修改后写回，fn返回nil时不写回
+func (s *SessionManager) GetAndSet(req *http.Request, rw http.ResponseWriter, fn func(map[string]interface{}) map[string]interface{}) error {
+	session := fn(s.Get(req))
+	if session == nil {
+		return nil
+	}
+
+	return s.set(session, rw, req)
+}
+
+func (s *SessionManager) set(session map[string]interface{}, rw http.ResponseWriter, req *http.Request) error {
 	origCookie, err := req.Cookie(s.CookieName)
 	var origCookieVal string
 	if err != nil {
@@ -164,7 +392,7 @@ func (s *SessionManager) Set(session map[string]interface{}, rw http.ResponseWri
 
 	if len(session) == 0 {
 		if origCookieVal != "" {
-			help.SetCookie(rw, nil, s.CookieName, "", -3600)
+			s.setCookie(rw, "", -3600)
 		}
 	} else {
 		var cookieExpires int
@@ -172,10 +400,34 @@ func (s *SessionManager) Set(session map[string]interface{}, rw http.ResponseWri
 			cookieExpires = ce
 		}
 
-		if encoded, err := encodeCookie(session, s.key, s.iv); err == nil {
-			if encoded != origCookieVal {
-				help.SetCookie(rw, nil, s.CookieName, encoded, cookieExpires, "/", s.CookieDomain, true)
-			}
+		encoded, err := s.encodeCookie(session)
+		if err != nil {
+			return err
+		}
+
+		if encoded != origCookieVal {
+			s.setCookie(rw, encoded, cookieExpires)
 		}
 	}
+
+	return nil
+}
+
+// 所有cookie均为Path=/、Secure、HttpOnly，与memorysession一致
+// cookieExpires为0时是浏览器会话cookie，为负数时删除cookie
+func (s *SessionManager) setCookie(rw http.ResponseWriter, value string, cookieExpires int) {
+	cookie := &http.Cookie{
+		Name:     s.CookieName,
+		Value:    value,
+		Path:     "/",
+		Domain:   s.CookieDomain,
+		Secure:   true,
+		HttpOnly: true,
+	}
+
+	if cookieExpires != 0 {
+		cookie.Expires = time.Now().Add(time.Duration(cookieExpires) * time.Second)
+	}
+
+	http.SetCookie(rw, cookie)
 }
@@ -0,0 +1,367 @@
+package cookiesession
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 取出响应中名为name的Set-Cookie，不存在时返回nil
+func responseCookie(rw *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+
+	return nil
+}
+
+func requestWithCookie(name, value string) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	if value != "" {
+		req.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+
+	return req
+}
+
+// 写入session并返回下发的cookie值
+func setSession(t *testing.T, s *SessionManager, session map[string]interface{}) string {
+	t.Helper()
+
+	rw := httptest.NewRecorder()
+	s.Set(session, rw, requestWithCookie(s.CookieName, ""))
+	c := responseCookie(rw, s.CookieName)
+	if c == nil {
+		t.Fatal("Set did not emit a Set-Cookie")
+	}
+
+	return c.Value
+}
+
+func TestTouch(t *testing.T) {
+	s := New("", "key", "")
+
+	session := map[string]interface{}{"uid": "1"}
+	s.SetCookieExpires(session, 3600)
+	value := setSession(t, s, session)
+
+	rw := httptest.NewRecorder()
+	if !s.Touch(rw, requestWithCookie(s.CookieName, value)) {
+		t.Fatal("Touch returned false for a valid cookie")
+	}
+
+	c := responseCookie(rw, s.CookieName)
+	if c == nil {
+		t.Fatal("Touch did not re-emit Set-Cookie")
+	}
+
+	if c.Value != value {
+		t.Errorf("Touch changed cookie value: got %q, want %q", c.Value, value)
+	}
+
+	if d := time.Until(c.Expires); d < 3590*time.Second || d > 3610*time.Second {
+		t.Errorf("Touch Expires is %v from now, want about 1h", d)
+	}
+}
+
+func TestTouchRejects(t *testing.T) {
+	s := New("", "key", "")
+	sessionCookie := setSession(t, s, map[string]interface{}{"uid": "1"})
+
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"no cookie", ""},
+		{"invalid cookie", "AAAA"},
+		{"session cookie without expires", sessionCookie},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			if s.Touch(rw, requestWithCookie(s.CookieName, tt.value)) {
+				t.Error("Touch returned true")
+			}
+
+			if c := responseCookie(rw, s.CookieName); c != nil {
+				t.Errorf("Touch emitted Set-Cookie %q", c.Value)
+			}
+		})
+	}
+}
+
+func TestGetAndSet(t *testing.T) {
+	s := New("", "key", "")
+	value := setSession(t, s, map[string]interface{}{"count": 1})
+
+	var seen interface{}
+	rw := httptest.NewRecorder()
+	err := s.GetAndSet(requestWithCookie(s.CookieName, value), rw, func(session map[string]interface{}) map[string]interface{} {
+		seen = session["count"]
+		session["count"] = session["count"].(int) + 1
+		return session
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if seen != 1 {
+		t.Errorf("fn saw count %v, want the stored 1", seen)
+	}
+
+	c := responseCookie(rw, s.CookieName)
+	if c == nil {
+		t.Fatal("GetAndSet did not emit Set-Cookie")
+	}
+
+	if got := s.Get(requestWithCookie(s.CookieName, c.Value)); got["count"] != 2 {
+		t.Errorf("persisted session = %v, want count 2", got)
+	}
+}
+
+func TestGetAndSetNil(t *testing.T) {
+	s := New("", "key", "")
+	value := setSession(t, s, map[string]interface{}{"count": 1})
+
+	rw := httptest.NewRecorder()
+	err := s.GetAndSet(requestWithCookie(s.CookieName, value), rw, func(map[string]interface{}) map[string]interface{} {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := responseCookie(rw, s.CookieName); c != nil {
+		t.Errorf("nil result emitted Set-Cookie %q", c.Value)
+	}
+}
+
+func TestChaCha20RoundTrip(t *testing.T) {
+	s := NewWithChaCha20("", "key", "")
+	value := setSession(t, s, map[string]interface{}{"uid": "1"})
+
+	if got := s.Get(requestWithCookie(s.CookieName, value)); got["uid"] != "1" {
+		t.Errorf("Get = %v, want uid 1", got)
+	}
+
+	if again := setSession(t, s, map[string]interface{}{"uid": "1"}); again == value {
+		t.Error("two encodings share a nonce")
+	}
+}
+
+func TestChaCha20UpgradesAESCookie(t *testing.T) {
+	legacy := New("", "key", "")
+	value := setSession(t, legacy, map[string]interface{}{"uid": "1"})
+
+	s := NewWithChaCha20("", "key", "")
+	req := requestWithCookie(s.CookieName, value)
+	session := s.Get(req)
+	if session["uid"] != "1" {
+		t.Fatalf("Get on AES-CBC cookie = %v, want uid 1", session)
+	}
+
+	rw := httptest.NewRecorder()
+	s.Set(session, rw, req)
+	c := responseCookie(rw, s.CookieName)
+	if c == nil {
+		t.Fatal("Set did not upgrade the cookie")
+	}
+
+	if _, err := decodeAEADCookie(c.Value, s.keys[0].aead); err != nil {
+		t.Errorf("upgraded cookie is not ChaCha20-Poly1305: %v", err)
+	}
+
+	if got := legacy.Get(requestWithCookie(s.CookieName, c.Value)); len(got) != 0 {
+		t.Errorf("AES-CBC manager decoded upgraded cookie: %v", got)
+	}
+}
+
+func TestMalformedCookie(t *testing.T) {
+	managers := map[string]*SessionManager{
+		"aes-cbc":  New("", "key", ""),
+		"chacha20": NewWithChaCha20("", "key", ""),
+		"hmac":     New("", "key", "", WithHMAC([]byte("auth"))),
+	}
+
+	values := []string{
+		"AAAA",
+		"AAAAAAAAAAAAAAAAAAAAAA==",
+		"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+		"not base64!",
+		".",
+	}
+
+	for name, s := range managers {
+		for _, value := range values {
+			t.Run(name+"/"+value, func(t *testing.T) {
+				if got := s.Get(requestWithCookie(s.CookieName, value)); len(got) != 0 {
+					t.Errorf("Get = %v, want empty", got)
+				}
+			})
+		}
+	}
+}
+
+// 将s中第i个base64字符替换为另一个合法字符
+func flipChar(s string, i int) string {
+	b := []byte(s)
+	if b[i] == 'A' {
+		b[i] = 'B'
+	} else {
+		b[i] = 'A'
+	}
+
+	return string(b)
+}
+
+func TestHMAC(t *testing.T) {
+	s := New("", "key", "", WithHMAC([]byte("auth")))
+	value := setSession(t, s, map[string]interface{}{"uid": "1"})
+	dot := strings.LastIndexByte(value, '.')
+	if dot < 0 {
+		t.Fatalf("signed cookie %q has no tag", value)
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		err   error
+	}{
+		{"signed round-trip", value, nil},
+		{"flipped payload", flipChar(value, 0), ErrCookieTampered},
+		{"flipped tag", flipChar(value, dot+1), ErrCookieTampered},
+		{"no tag", value[:dot], ErrCookieTampered},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, _, err := s.decodeCookie(tt.value)
+			if err != tt.err {
+				t.Fatalf("decodeCookie error = %v, want %v", err, tt.err)
+			}
+
+			if tt.err == nil && session["uid"] != "1" {
+				t.Errorf("decodeCookie = %v, want uid 1", session)
+			}
+		})
+	}
+}
+
+func TestHMACRejectsUnsignedCookie(t *testing.T) {
+	unsigned := setSession(t, New("", "key", ""), map[string]interface{}{"uid": "1"})
+
+	s := New("", "key", "", WithHMAC([]byte("auth")))
+	if _, _, err := s.decodeCookie(unsigned); err != ErrCookieTampered {
+		t.Errorf("decodeCookie error = %v, want ErrCookieTampered", err)
+	}
+
+	if got := s.Get(requestWithCookie(s.CookieName, unsigned)); len(got) != 0 {
+		t.Errorf("Get = %v, want empty", got)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	constructors := []struct {
+		name string
+		new  func(cookieName, key, cookieDomain string, opts ...Option) *SessionManager
+	}{
+		{"aes-cbc", New},
+		{"chacha20", NewWithChaCha20},
+	}
+
+	for _, constructor := range constructors {
+		newManager := constructor.new
+		t.Run(constructor.name, func(t *testing.T) {
+			old := newManager("", "", "", WithKeyRotation([][]byte{[]byte("old")}))
+			session := map[string]interface{}{"uid": "1"}
+			old.SetCookieExpires(session, 3600)
+			value := setSession(t, old, session)
+
+			rotated := newManager("", "", "", WithKeyRotation([][]byte{[]byte("new"), []byte("old")}))
+			current := newManager("", "", "", WithKeyRotation([][]byte{[]byte("new")}))
+			req := requestWithCookie(rotated.CookieName, value)
+
+			got := rotated.Get(req)
+			if got["uid"] != "1" {
+				t.Fatalf("Get with rotated keys = %v, want uid 1", got)
+			}
+
+			upgrades := map[string]func(rw *httptest.ResponseRecorder){
+				"Set":   func(rw *httptest.ResponseRecorder) { rotated.Set(got, rw, req) },
+				"Touch": func(rw *httptest.ResponseRecorder) { rotated.Touch(rw, req) },
+			}
+
+			for name, upgrade := range upgrades {
+				rw := httptest.NewRecorder()
+				upgrade(rw)
+				c := responseCookie(rw, rotated.CookieName)
+				if c == nil {
+					t.Fatalf("%s did not re-issue the cookie", name)
+				}
+
+				if got := current.Get(requestWithCookie(current.CookieName, c.Value)); got["uid"] != "1" {
+					t.Errorf("%s cookie does not decode with the new key alone: %v", name, got)
+				}
+			}
+		})
+	}
+}
+
+func TestCookieAttributes(t *testing.T) {
+	s := New("", "key", "example.com")
+	session := map[string]interface{}{"uid": "1"}
+	s.SetCookieExpires(session, 3600)
+	value := setSession(t, s, session)
+
+	rw := httptest.NewRecorder()
+	s.Set(map[string]interface{}{}, rw, requestWithCookie(s.CookieName, value))
+	deleted := responseCookie(rw, s.CookieName)
+	if deleted == nil {
+		t.Fatal("Set with an empty session did not emit a delete cookie")
+	}
+
+	rw = httptest.NewRecorder()
+	s.Set(session, rw, requestWithCookie(s.CookieName, ""))
+	set := responseCookie(rw, s.CookieName)
+
+	for name, c := range map[string]*http.Cookie{"set": set, "delete": deleted} {
+		if c.Path != "/" || c.Domain != "example.com" || !c.Secure || !c.HttpOnly {
+			t.Errorf("%s cookie = %+v, want Path=/ Domain=example.com Secure HttpOnly", name, c)
+		}
+	}
+
+	if d := time.Until(set.Expires); d < 3590*time.Second || d > 3610*time.Second {
+		t.Errorf("set cookie Expires is %v from now, want about 1h", d)
+	}
+
+	if !deleted.Expires.Before(time.Now()) || deleted.Value != "" {
+		t.Errorf("delete cookie = %+v, want an empty, already expired cookie", deleted)
+	}
+}
+
+func TestWithoutCBCFallback(t *testing.T) {
+	legacy := setSession(t, New("", "key", ""), map[string]interface{}{"uid": "1"})
+
+	s := NewWithChaCha20("", "key", "", WithoutCBCFallback())
+	if got := s.Get(requestWithCookie(s.CookieName, legacy)); len(got) != 0 {
+		t.Errorf("Get of AES-CBC cookie = %v, want empty", got)
+	}
+
+	value := setSession(t, s, map[string]interface{}{"uid": "1"})
+	if got := s.Get(requestWithCookie(s.CookieName, value)); got["uid"] != "1" {
+		t.Errorf("Get of ChaCha20 cookie = %v, want uid 1", got)
+	}
+
+	rotated := NewWithChaCha20("", "", "", WithoutCBCFallback(), WithKeyRotation([][]byte{[]byte("new"), []byte("key")}))
+	if got := rotated.Get(requestWithCookie(s.CookieName, value)); got["uid"] != "1" {
+		t.Errorf("Get of ChaCha20 cookie under an old key = %v, want uid 1", got)
+	}
+	if got := rotated.Get(requestWithCookie(s.CookieName, legacy)); len(got) != 0 {
+		t.Errorf("Get of AES-CBC cookie under an old key = %v, want empty", got)
+	}
+}
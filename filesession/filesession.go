@@ -17,20 +17,23 @@ package filesession
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/gob"
-
-	//(1)
-	//"errors"
-	//(1)
+	"encoding/hex"
+	"errors"
 	"github.com/haiyiyun/log"
-	"github.com/haiyiyun/utils/help"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 
 	//(1)
@@ -43,6 +46,11 @@ var (
 	sessionLock sync.RWMutex
 )
 
+var (
+	ErrLegacyUnencryptedSession = errors.New("filesession: legacy unencrypted session file")
+	ErrSessionDecryptionFailed  = errors.New("filesession: session file decryption failed")
+)
+
 func init() {
 	gob.Register([]interface{}{})
 	gob.Register(map[int]interface{}{})
@@ -109,7 +117,7 @@ func readFile(filePath string) ([]byte, error) {
 
 	return content, err
 }
-func writeFile(filePath string, content []byte) error {
+func writeFile(filePath string, content []byte, perm os.FileMode) error {
 	var tryed bool
 TRY:
 	//(1)
@@ -139,20 +147,74 @@ TRY:
 
 	//(2)
 	sessionLock.Lock()
-	err := ioutil.WriteFile(filePath, content, os.ModePerm)
+	err := atomicWriteFile(filePath, content, perm)
 	sessionLock.Unlock()
 	//(2)
 
 	if !tryed && err != nil {
 		tryed = true
 		sessionDir := filepath.Dir(filePath)
-		os.MkdirAll(sessionDir, 0777)
+		os.MkdirAll(sessionDir, dirPerm(perm))
 		goto TRY
 	}
 
 	return err
 }
 
+// 先写入临时文件并Sync，再重命名覆盖目标文件，避免写入中断时留下残缺的session文件
+func atomicWriteFile(filePath string, content []byte, perm os.FileMode) error {
+	tmpPath := filePath + ".tmp." + strconv.Itoa(os.Getpid())
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	//OpenFile受umask影响，这里显式设置为perm
+	if err = f.Chmod(perm); err == nil {
+		if _, err = f.Write(content); err == nil {
+			err = f.Sync()
+		}
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = renameFile(tmpPath, filePath)
+	}
+
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+
+	return err
+}
+
+// 目录需要执行权限才能访问其中的文件，为有读权限的用户补上执行权限
+func dirPerm(perm os.FileMode) os.FileMode {
+	return perm | (perm&0444)>>2
+}
+
+func readDir(dir string) ([]os.FileInfo, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return f.Readdir(-1)
+}
+
+func isSessionFile(fi os.FileInfo) bool {
+	return !fi.IsDir() && strings.HasSuffix(fi.Name(), ".haiyiyun")
+}
+
+// atomicWriteFile中断时可能遗留的临时文件
+func isTempFile(fi os.FileInfo) bool {
+	return !fi.IsDir() && strings.Contains(fi.Name(), ".haiyiyun.tmp.")
+}
+
 func getSessionSign() string {
 	var n int = 24
 	b := make([]byte, n)
@@ -168,9 +230,65 @@ type SessionManager struct {
 	expires       int
 	sessionDir    string
 	timerDuration time.Duration
+	gcOnStart     bool
+	perm          os.FileMode
+	gcWorkers     int
+	buckets       uint8
+	aead          cipher.AEAD
+	migrateLegacy bool
+}
+
+type Option func(*SessionManager)
+
+// 设置session文件的权限，默认为0600，session目录的权限由此推导
+func WithFilePerm(perm os.FileMode) Option {
+	return func(s *SessionManager) {
+		s.perm = perm
+	}
+}
+
+// 使用AES-256-GCM加密session文件，key经sha256后作为密钥，每个文件前12字节为随机nonce
+func WithFileEncryption(key []byte) Option {
+	return func(s *SessionManager) {
+		sum := sha256.Sum256(key)
+		block, _ := aes.NewCipher(sum[:])
+		s.aead, _ = cipher.NewGCM(block)
+	}
+}
+
+// 读取到未加密的旧session文件时，自动加密后重新写入，而不是返回ErrLegacyUnencryptedSession
+func WithFileEncryptionMigration() Option {
+	return func(s *SessionManager) {
+		s.migrateLegacy = true
+	}
+}
+
+// 将session文件分散到sessionDir下buckets个子目录(以16进制命名)中，为0时不分目录
+// sign是base64而不是hex，子目录由sign首字节对buckets取模得到，buckets为16时即为0-f
+// 启用前写入根目录的session文件仍会被GC、IterExpired和Len处理，并在Get首次读取时移入对应子目录
+func WithSharding(buckets uint8) Option {
+	return func(s *SessionManager) {
+		s.buckets = buckets
+	}
+}
+
+// 设置GC时并行删除过期session文件的goroutine数量，默认为1
+func WithGCWorkers(n int) Option {
+	return func(s *SessionManager) {
+		if n > 0 {
+			s.gcWorkers = n
+		}
+	}
 }
 
-func New(cookieName, cookieDomain string, expires int, sessionDir string, timerDuration string) *SessionManager {
+// 在New返回前先执行一次GC，清理上次运行遗留的过期session文件
+func WithGCOnStart(gcOnStart bool) Option {
+	return func(s *SessionManager) {
+		s.gcOnStart = gcOnStart
+	}
+}
+
+func New(cookieName, cookieDomain string, expires int, sessionDir string, timerDuration string, opts ...Option) *SessionManager {
 	if cookieName == "" {
 		cookieName = "HaiyiyunSession"
 	}
@@ -197,39 +315,191 @@ func New(cookieName, cookieDomain string, expires int, sessionDir string, timerD
 		expires:       expires,
 		sessionDir:    sessionDir,
 		timerDuration: dTimerDuration,
+		perm:          0600,
+		gcWorkers:     1,
 	}
 
-	time.AfterFunc(s.timerDuration, func() { s.GC() })
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.gcOnStart {
+		s.GC()
+	}
+
+	go s.gcLoop()
 
 	return s
 }
 
+func (s *SessionManager) shardDir(sessionSign string) string {
+	if s.buckets == 0 || sessionSign == "" {
+		return s.sessionDir
+	}
+
+	return s.sessionDir + strconv.FormatUint(uint64(sessionSign[0]%s.buckets), 16) + "/"
+}
+
+func (s *SessionManager) sessionFile(sessionSign string) string {
+	return s.shardDir(sessionSign) + sessionSign + ".haiyiyun"
+}
+
+// 启用分目录时同时返回根目录，以处理启用前写入的session文件
+func (s *SessionManager) sessionDirs() []string {
+	dirs := make([]string, 0, int(s.buckets)+1)
+	dirs = append(dirs, s.sessionDir)
+	for i := 0; i < int(s.buckets); i++ {
+		dirs = append(dirs, s.sessionDir+strconv.FormatUint(uint64(i), 16)+"/")
+	}
+
+	return dirs
+}
+
+func (s *SessionManager) encodeSession(session map[string]interface{}) ([]byte, error) {
+	content, err := encodeGob(session)
+	if err != nil || s.aead == nil {
+		return content, err
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return s.aead.Seal(nonce, nonce, content, nil), nil
+}
+
+// legacy为true表示content是未加密的旧session文件
+func (s *SessionManager) decodeSession(content []byte) (session map[string]interface{}, legacy bool, err error) {
+	if s.aead == nil {
+		session, err = decodeGob(content)
+		return
+	}
+
+	nonceSize := s.aead.NonceSize()
+	if len(content) >= nonceSize+s.aead.Overhead() {
+		if plain, oerr := s.aead.Open(nil, content[:nonceSize], content[nonceSize:], nil); oerr == nil {
+			session, err = decodeGob(plain)
+			return
+		}
+	}
+
+	//无法解密时，能按Gob解码的视为未加密的旧session文件
+	if session, err = decodeGob(content); err == nil {
+		legacy = true
+		if !s.migrateLegacy {
+			session, err = nil, ErrLegacyUnencryptedSession
+		}
+	} else {
+		err = ErrSessionDecryptionFailed
+	}
+
+	return
+}
+
 func (s *SessionManager) new(rw http.ResponseWriter) string {
 	sessionSign := getSessionSign()
-	help.SetCookie(rw, nil, s.CookieName, sessionSign, 0, "/", s.CookieDomain, true)
+	s.setCookie(rw, sessionSign)
 
 	return sessionSign
 }
 
+// session标识cookie为浏览器会话cookie，Secure、HttpOnly与memorysession一致
+func (s *SessionManager) setCookie(rw http.ResponseWriter, sessionSign string) {
+	http.SetCookie(rw, &http.Cookie{
+		Name:     s.CookieName,
+		Value:    sessionSign,
+		Path:     "/",
+		Domain:   s.CookieDomain,
+		Secure:   true,
+		HttpOnly: true,
+	})
+}
+
 func (s *SessionManager) Get(rw http.ResponseWriter, req *http.Request) map[string]interface{} {
+	m, err := s.GetWithError(rw, req)
+	if err != nil {
+		log.Error("<SessionManager.Get> ", "GetWithError:", err)
+		return map[string]interface{}{}
+	}
+
+	return m
+}
+
+// 与Get相同，但会返回读取或解码session文件时的错误
+// 未启用WithFileEncryptionMigration时，读取到未加密的旧文件返回ErrLegacyUnencryptedSession，无法解密时返回ErrSessionDecryptionFailed
+// session文件不存在不视为错误
+func (s *SessionManager) GetWithError(rw http.ResponseWriter, req *http.Request) (map[string]interface{}, error) {
 	m := map[string]interface{}{}
 
-	if c, err := req.Cookie(s.CookieName); err == nil {
-		sessionSign := c.Value
-		if content, err := readFile(s.sessionDir + sessionSign + ".haiyiyun"); err == nil {
-			if len(content) > 0 {
-				if dm, err := decodeGob(content); err == nil {
-					m = dm
-				} else {
-					log.Error("<SessionManager.Get> ", "decodeGob:", err)
-				}
-			}
-		}
-	} else {
+	c, err := req.Cookie(s.CookieName)
+	if err != nil {
 		s.new(rw)
+		return m, nil
 	}
 
-	return m
+	sessionSign := c.Value
+	content, err := readFile(s.sessionFile(sessionSign))
+	if os.IsNotExist(err) && s.moveFlatFile(sessionSign) {
+		content, err = readFile(s.sessionFile(sessionSign))
+	}
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return m, err
+	}
+
+	if len(content) == 0 {
+		return m, nil
+	}
+
+	dm, legacy, err := s.decodeSession(content)
+	if err != nil {
+		return m, err
+	}
+
+	if legacy {
+		s.Set(dm, rw, req)
+	}
+
+	return dm, nil
+}
+
+// 将启用分目录前写入根目录的session文件移入对应子目录，移动成功时返回true
+// 按sign访问session文件的方法都应先调用，使旧文件与分目录后的文件行为一致
+func (s *SessionManager) moveFlatFile(sessionSign string) bool {
+	if s.buckets == 0 || sessionSign == "" {
+		return false
+	}
+
+	flatPath := s.sessionDir + sessionSign + ".haiyiyun"
+	newPath := s.sessionFile(sessionSign)
+
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+
+	if _, err := os.Stat(flatPath); err != nil {
+		return false
+	}
+
+	//子目录中已有的文件更新，不用旧文件覆盖
+	if _, err := os.Stat(newPath); err == nil {
+		return false
+	}
+
+	err := os.MkdirAll(filepath.Dir(newPath), dirPerm(s.perm))
+	if err == nil {
+		err = os.Rename(flatPath, newPath)
+	}
+
+	if err != nil {
+		log.Error("<SessionManager.moveFlatFile> ", "os.Rename:", err)
+		return false
+	}
+
+	return true
 }
 
 func (s *SessionManager) Set(session map[string]interface{}, rw http.ResponseWriter, req *http.Request) {
@@ -238,21 +508,21 @@ func (s *SessionManager) Set(session map[string]interface{}, rw http.ResponseWri
 	if cerr == nil {
 		sessionSign := c.Value
 		if lsess > 0 {
-			if encodeSession, err := encodeGob(session); err == nil {
-				writeFile(s.sessionDir+sessionSign+".haiyiyun", encodeSession)
+			if encodeSession, err := s.encodeSession(session); err == nil {
+				writeFile(s.sessionFile(sessionSign), encodeSession, s.perm)
 			} else {
-				log.Error("<SessionManager.Set> ", "encodeGob:", err)
+				log.Error("<SessionManager.Set> ", "encodeSession:", err)
 			}
 		} else {
 			s.Clear(sessionSign)
 		}
 	} else {
 		if lsess > 0 {
-			if encodeSession, err := encodeGob(session); err == nil {
+			if encodeSession, err := s.encodeSession(session); err == nil {
 				sessionSign := s.new(rw)
-				writeFile(s.sessionDir+sessionSign+".haiyiyun", encodeSession)
+				writeFile(s.sessionFile(sessionSign), encodeSession, s.perm)
 			} else {
-				log.Error("<SessionManager.Set> ", "encodeGob:", err)
+				log.Error("<SessionManager.Set> ", "encodeSession:", err)
 			}
 		}
 	}
@@ -260,29 +530,163 @@ func (s *SessionManager) Set(session map[string]interface{}, rw http.ResponseWri
 
 func (s *SessionManager) Len() int64 {
 	var slen int64
-	if fs, err := filepath.Glob(s.sessionDir + "*.haiyiyun"); err == nil {
-		slen = int64(len(fs))
+	for _, dir := range s.sessionDirs() {
+		if fs, err := filepath.Glob(dir + "*.haiyiyun"); err == nil {
+			slen += int64(len(fs))
+		}
 	}
 
 	return slen
 }
 
 func (s *SessionManager) Clear(sessionSign string) {
-	os.Remove(s.sessionDir + sessionSign + ".haiyiyun")
+	os.Remove(s.sessionFile(sessionSign))
+	if s.buckets > 0 && sessionSign != "" {
+		//避免启用分目录前写入的文件在下次Get时被移入子目录而恢复
+		os.Remove(s.sessionDir + sessionSign + ".haiyiyun")
+	}
 }
 
+// 更换session标识时直接重命名session文件，无需重新编码数据，文件的修改时间保持不变
+// newSign已存在时返回os.IsExist可判断的错误，不会覆盖其他用户的session
+// Rename只处理文件，可在请求之外调用；需要同时下发新cookie时使用RenameWithCookie
+func (s *SessionManager) Rename(oldSign, newSign string) error {
+	s.moveFlatFile(oldSign)
+	s.moveFlatFile(newSign)
+
+	oldPath := s.sessionFile(oldSign)
+	newPath := s.sessionFile(newSign)
+
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+
+	if _, err := os.Stat(newPath); err == nil {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: os.ErrExist}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(newPath), dirPerm(s.perm)); err != nil {
+		return err
+	}
+
+	return os.Rename(oldPath, newPath)
+}
+
+// 与Rename相同，成功后通过rw下发newSign的cookie
+func (s *SessionManager) RenameWithCookie(rw http.ResponseWriter, oldSign, newSign string) error {
+	if err := s.Rename(oldSign, newSign); err != nil {
+		return err
+	}
+
+	s.setCookie(rw, newSign)
+
+	return nil
+}
+
+// 返回session文件的最后修改时间，可用于Last-Modified/If-Modified-Since
+func (s *SessionManager) GetLastModified(sign string) (time.Time, error) {
+	s.moveFlatFile(sign)
+
+	sessionLock.RLock()
+	fi, err := os.Stat(s.sessionFile(sign))
+	sessionLock.RUnlock()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return fi.ModTime(), nil
+}
+
+// 返回session文件内容的sha1摘要，可用作ETag
+func (s *SessionManager) GetETag(sign string) (string, error) {
+	s.moveFlatFile(sign)
+
+	content, err := readFile(s.sessionFile(sign))
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha1.Sum(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// 遍历已过期但尚未被GC删除的session，age为已过期的时长
+// fn返回false时停止遍历，返回已遍历的过期session数量
+func (s *SessionManager) IterExpired(fn func(sign string, age time.Duration) bool) int {
+	var count int
+	now := time.Now()
+	for _, dir := range s.sessionDirs() {
+		fis, err := readDir(dir)
+		if err != nil {
+			continue
+		}
+
+		for _, fi := range fis {
+			if !isSessionFile(fi) {
+				continue
+			}
+
+			age := now.Sub(fi.ModTime().Add(time.Duration(s.expires) * time.Second))
+			if age < 0 {
+				continue
+			}
+
+			count++
+			if !fn(strings.TrimSuffix(fi.Name(), ".haiyiyun"), age) {
+				return count
+			}
+		}
+	}
+
+	return count
+}
+
+// 执行一次GC，由gcWorkers个goroutine并行删除过期的session文件
+// 与IterExpired使用相同的过滤条件，另外会删除过期的写入临时文件，目录中的其他文件不受影响
 func (s *SessionManager) GC() {
-	if f, err := os.Open(s.sessionDir); err == nil {
-		if fis, err := f.Readdir(-1); err == nil {
+	var (
+		wg     sync.WaitGroup
+		mutex  sync.Mutex
+		errs   []error
+		queue  = make(chan string, s.gcWorkers)
+		expire = time.Now().Unix() - int64(s.expires)
+	)
+
+	for i := 0; i < s.gcWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for filePath := range queue {
+				if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+					mutex.Lock()
+					errs = append(errs, err)
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, dir := range s.sessionDirs() {
+		if fis, err := readDir(dir); err == nil {
 			for _, fi := range fis {
-				if fi.ModTime().Unix()+int64(s.expires) <= time.Now().Unix() {
-					os.Remove(s.sessionDir + fi.Name())
+				if (isSessionFile(fi) || isTempFile(fi)) && fi.ModTime().Unix() <= expire {
+					queue <- dir + fi.Name()
 				}
 			}
 		}
+	}
+
+	close(queue)
+	wg.Wait()
 
-		defer f.Close()
+	for _, err := range errs {
+		log.Error("<SessionManager.GC> ", "os.Remove:", err)
 	}
+}
 
-	time.AfterFunc(s.timerDuration, func() { s.GC() })
+// 上一次GC完成后再等待timerDuration，避免GC耗时过长时多次GC叠加执行
+func (s *SessionManager) gcLoop() {
+	for {
+		time.Sleep(s.timerDuration)
+		s.GC()
+	}
 }
@@ -0,0 +1,506 @@
+package filesession
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestManager(t *testing.T, opts ...Option) *SessionManager {
+	t.Helper()
+
+	return New("", "", 3600, t.TempDir()+"/", "1h", opts...)
+}
+
+func requestWithCookie(name, value string) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	if value != "" {
+		req.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+
+	return req
+}
+
+// 以sign为cookie写入session
+func setSession(t *testing.T, s *SessionManager, sign string, session map[string]interface{}) {
+	t.Helper()
+
+	s.Set(session, httptest.NewRecorder(), requestWithCookie(s.CookieName, sign))
+	if _, err := os.Stat(s.sessionFile(sign)); err != nil {
+		t.Fatalf("Set did not write %s: %v", sign, err)
+	}
+}
+
+func getSession(s *SessionManager, sign string) map[string]interface{} {
+	return s.Get(httptest.NewRecorder(), requestWithCookie(s.CookieName, sign))
+}
+
+// 将sign的session文件修改时间调整到d之前
+func age(t *testing.T, s *SessionManager, sign string, d time.Duration) time.Time {
+	t.Helper()
+
+	mtime := time.Now().Add(-d).Truncate(time.Second)
+	if err := os.Chtimes(s.sessionFile(sign), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	return mtime
+}
+
+func TestRename(t *testing.T) {
+	s := newTestManager(t)
+	setSession(t, s, "old", map[string]interface{}{"uid": "1"})
+	mtime := age(t, s, "old", 2*time.Hour)
+
+	rw := httptest.NewRecorder()
+	if err := s.RenameWithCookie(rw, "old", "new"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(s.sessionFile("old")); !os.IsNotExist(err) {
+		t.Errorf("old session file still exists: %v", err)
+	}
+
+	if got := getSession(s, "new"); got["uid"] != "1" {
+		t.Errorf("renamed session = %v, want uid 1", got)
+	}
+
+	if got, err := s.GetLastModified("new"); err != nil || !got.Equal(mtime) {
+		t.Errorf("renamed mtime = %v, %v; want %v", got, err, mtime)
+	}
+
+	var expired []string
+	s.IterExpired(func(sign string, age time.Duration) bool {
+		expired = append(expired, sign)
+		return true
+	})
+	if len(expired) != 1 || expired[0] != "new" {
+		t.Errorf("IterExpired visited %v, want [new]", expired)
+	}
+
+	var cookie *http.Cookie
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == s.CookieName {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Value != "new" {
+		t.Fatalf("RenameWithCookie cookie = %v, want new", cookie)
+	}
+
+	if cookie.Path != "/" || !cookie.Secure || !cookie.HttpOnly || !cookie.Expires.IsZero() {
+		t.Errorf("RenameWithCookie cookie = %+v, want a Path=/ Secure HttpOnly session cookie", cookie)
+	}
+}
+
+func TestRenameExistingTarget(t *testing.T) {
+	s := newTestManager(t)
+	setSession(t, s, "old", map[string]interface{}{"uid": "1"})
+	setSession(t, s, "taken", map[string]interface{}{"uid": "2"})
+
+	rw := httptest.NewRecorder()
+	if err := s.RenameWithCookie(rw, "old", "taken"); !os.IsExist(err) {
+		t.Fatalf("Rename error = %v, want os.IsExist", err)
+	}
+
+	if got := getSession(s, "taken"); got["uid"] != "2" {
+		t.Errorf("existing session overwritten: %v", got)
+	}
+
+	if got := getSession(s, "old"); got["uid"] != "1" {
+		t.Errorf("old session lost: %v", got)
+	}
+
+	if len(rw.Result().Cookies()) != 0 {
+		t.Error("failed RenameWithCookie emitted a cookie")
+	}
+}
+
+func TestLastModifiedAndETag(t *testing.T) {
+	s := newTestManager(t)
+	setSession(t, s, "sign", map[string]interface{}{"uid": "1"})
+	before := age(t, s, "sign", time.Minute)
+
+	etag, err := s.GetETag("sign")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setSession(t, s, "sign", map[string]interface{}{"uid": "2"})
+
+	if got, err := s.GetLastModified("sign"); err != nil || !got.After(before) {
+		t.Errorf("GetLastModified after write = %v, %v; want after %v", got, err, before)
+	}
+
+	if got, err := s.GetETag("sign"); err != nil || got == etag {
+		t.Errorf("GetETag after write = %q, %v; want a new ETag", got, err)
+	}
+}
+
+func TestLastModifiedAndETagMissing(t *testing.T) {
+	s := newTestManager(t)
+
+	if _, err := s.GetLastModified("missing"); !os.IsNotExist(err) {
+		t.Errorf("GetLastModified error = %v, want os.IsNotExist", err)
+	}
+
+	if _, err := s.GetETag("missing"); !os.IsNotExist(err) {
+		t.Errorf("GetETag error = %v, want os.IsNotExist", err)
+	}
+}
+
+func TestGCOnStart(t *testing.T) {
+	dir := t.TempDir() + "/"
+	previous := New("", "", 3600, dir, "1h")
+	for _, sign := range []string{"stale1", "stale2", "fresh"} {
+		setSession(t, previous, sign, map[string]interface{}{"uid": sign})
+	}
+	age(t, previous, "stale1", 2*time.Hour)
+	age(t, previous, "stale2", 2*time.Hour)
+
+	s := New("", "", 3600, dir, "1h", WithGCOnStart(true))
+
+	for _, sign := range []string{"stale1", "stale2"} {
+		if _, err := os.Stat(s.sessionFile(sign)); !os.IsNotExist(err) {
+			t.Errorf("%s survived New: %v", sign, err)
+		}
+	}
+
+	if got := getSession(s, "fresh"); got["uid"] != "fresh" {
+		t.Errorf("fresh session = %v, want uid fresh", got)
+	}
+}
+
+func TestIterExpired(t *testing.T) {
+	s := newTestManager(t)
+	expired := map[string]bool{"e1": true, "e2": true, "e3": true}
+	for _, sign := range []string{"e1", "e2", "e3", "f1", "f2"} {
+		setSession(t, s, sign, map[string]interface{}{"uid": sign})
+		if expired[sign] {
+			age(t, s, sign, 2*time.Hour)
+		}
+	}
+
+	other := s.sessionDir + "notes.txt"
+	if err := os.WriteFile(other, []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(other, old, old)
+
+	visited := map[string]bool{}
+	count := s.IterExpired(func(sign string, age time.Duration) bool {
+		if age < time.Hour-time.Second {
+			t.Errorf("%s age = %v, want about 1h", sign, age)
+		}
+		visited[sign] = true
+		return true
+	})
+	if count != 3 || len(visited) != 3 {
+		t.Fatalf("IterExpired = %d, visited %v; want the 3 expired", count, visited)
+	}
+	for sign := range expired {
+		if !visited[sign] {
+			t.Errorf("%s not visited", sign)
+		}
+	}
+
+	if count := s.IterExpired(func(string, time.Duration) bool { return false }); count != 1 {
+		t.Errorf("IterExpired stopping early = %d, want 1", count)
+	}
+
+	s.GC()
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("GC removed a file IterExpired ignores: %v", err)
+	}
+}
+
+func TestFailedWriteKeepsPreviousFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, s *SessionManager, tmpPath string)
+	}{
+		{"temp path is a directory", func(t *testing.T, s *SessionManager, tmpPath string) {
+			if err := os.Mkdir(tmpPath, 0700); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"read-only directory", func(t *testing.T, s *SessionManager, tmpPath string) {
+			if os.Geteuid() == 0 {
+				t.Skip("root ignores directory permissions")
+			}
+			if err := os.Chmod(s.sessionDir, 0500); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { os.Chmod(s.sessionDir, 0700) })
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestManager(t)
+			setSession(t, s, "sign", map[string]interface{}{"uid": "1"})
+			before, err := os.ReadFile(s.sessionFile("sign"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tmpPath := s.sessionFile("sign") + ".tmp." + strconv.Itoa(os.Getpid())
+			tt.setup(t, s, tmpPath)
+
+			content, err := s.encodeSession(map[string]interface{}{"uid": "2"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := writeFile(s.sessionFile("sign"), content, s.perm); err == nil {
+				t.Fatal("writeFile succeeded")
+			}
+
+			if after, err := os.ReadFile(s.sessionFile("sign")); err != nil || !bytes.Equal(after, before) {
+				t.Errorf("session file changed after failed write: %v", err)
+			}
+
+			if fi, err := os.Stat(tmpPath); err == nil && !fi.IsDir() {
+				t.Errorf("temp file %s left behind", tmpPath)
+			}
+		})
+	}
+}
+
+func TestFilePerm(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []Option
+		filePerm os.FileMode
+		dirPerm  os.FileMode
+	}{
+		{"default", nil, 0600, 0700},
+		{"custom", []Option{WithFilePerm(0640)}, 0640, 0750},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir() + "/sessions/"
+			s := New("", "", 3600, dir, "1h", tt.opts...)
+			setSession(t, s, "sign", map[string]interface{}{"uid": "1"})
+
+			if fi, err := os.Stat(s.sessionFile("sign")); err != nil {
+				t.Error(err)
+			} else if fi.Mode().Perm() != tt.filePerm {
+				t.Errorf("file mode = %v, want %v", fi.Mode().Perm(), tt.filePerm)
+			}
+
+			if fi, err := os.Stat(dir); err != nil {
+				t.Error(err)
+			} else if fi.Mode().Perm() != tt.dirPerm {
+				t.Errorf("dir mode = %v, want %v", fi.Mode().Perm(), tt.dirPerm)
+			}
+		})
+	}
+}
+
+func TestDirPerm(t *testing.T) {
+	tests := map[os.FileMode]os.FileMode{
+		0600: 0700,
+		0640: 0750,
+		0644: 0755,
+		0200: 0200,
+	}
+
+	for perm, want := range tests {
+		if got := dirPerm(perm); got != want {
+			t.Errorf("dirPerm(%v) = %v, want %v", perm, got, want)
+		}
+	}
+}
+
+func TestGCWorkers(t *testing.T) {
+	const expired, fresh = 20, 7
+
+	s := newTestManager(t, WithGCWorkers(4))
+	for i := 0; i < expired+fresh; i++ {
+		sign := "s" + strconv.Itoa(i)
+		setSession(t, s, sign, map[string]interface{}{"uid": sign})
+		if i < expired {
+			age(t, s, sign, 2*time.Hour)
+		}
+	}
+
+	s.GC()
+
+	for i := 0; i < expired+fresh; i++ {
+		sign := "s" + strconv.Itoa(i)
+		_, err := os.Stat(s.sessionFile(sign))
+		if i < expired && !os.IsNotExist(err) {
+			t.Errorf("expired %s survived GC: %v", sign, err)
+		}
+		if i >= expired && err != nil {
+			t.Errorf("fresh %s removed by GC: %v", sign, err)
+		}
+	}
+
+	if n := s.Len(); n != fresh {
+		t.Errorf("Len after GC = %d, want %d", n, fresh)
+	}
+}
+
+func TestShardingFlatFiles(t *testing.T) {
+	dir := t.TempDir() + "/"
+	flat := New("", "", 3600, dir, "1h")
+	for _, sign := range []string{"stale", "fresh", "cleared", "modified", "tagged", "renamed", "taken"} {
+		setSession(t, flat, sign, map[string]interface{}{"uid": sign})
+	}
+	age(t, flat, "stale", 2*time.Hour)
+	mtime := age(t, flat, "modified", time.Minute)
+	etag, err := flat.GetETag("tagged")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := New("", "", 3600, dir, "1h", WithSharding(16))
+
+	var expired []string
+	s.IterExpired(func(sign string, age time.Duration) bool {
+		expired = append(expired, sign)
+		return true
+	})
+	if len(expired) != 1 || expired[0] != "stale" {
+		t.Errorf("IterExpired visited %v, want [stale]", expired)
+	}
+
+	s.GC()
+	if _, err := os.Stat(flat.sessionFile("stale")); !os.IsNotExist(err) {
+		t.Errorf("GC left the flat stale file: %v", err)
+	}
+
+	if n := s.Len(); n != 6 {
+		t.Errorf("Len = %d, want 6", n)
+	}
+
+	if got, err := s.GetLastModified("modified"); err != nil || !got.Equal(mtime) {
+		t.Errorf("GetLastModified of flat session = %v, %v; want %v", got, err, mtime)
+	}
+
+	if got, err := s.GetETag("tagged"); err != nil || got != etag {
+		t.Errorf("GetETag of flat session = %q, %v; want %q", got, err, etag)
+	}
+
+	if err := s.Rename("renamed", "taken"); !os.IsExist(err) {
+		t.Errorf("Rename onto flat session error = %v, want os.IsExist", err)
+	}
+
+	if err := s.Rename("renamed", "renamed2"); err != nil {
+		t.Errorf("Rename of flat session: %v", err)
+	} else if got := getSession(s, "renamed2"); got["uid"] != "renamed" {
+		t.Errorf("renamed flat session = %v, want uid renamed", got)
+	}
+
+	if got := getSession(s, "taken"); got["uid"] != "taken" {
+		t.Errorf("flat rename target overwritten: %v", got)
+	}
+
+	if got := getSession(s, "fresh"); got["uid"] != "fresh" {
+		t.Fatalf("Get of flat session = %v, want uid fresh", got)
+	}
+	if _, err := os.Stat(flat.sessionFile("fresh")); !os.IsNotExist(err) {
+		t.Errorf("flat file not moved: %v", err)
+	}
+	if _, err := os.Stat(s.sessionFile("fresh")); err != nil {
+		t.Errorf("bucket file missing: %v", err)
+	}
+
+	s.Clear("cleared")
+	if got := getSession(s, "cleared"); len(got) != 0 {
+		t.Errorf("cleared flat session came back: %v", got)
+	}
+}
+
+func TestShardDir(t *testing.T) {
+	s := New("", "", 3600, "/sessions/", "1h", WithSharding(16))
+	dirs := map[string]bool{}
+	for _, dir := range s.sessionDirs()[1:] {
+		dirs[dir] = true
+	}
+
+	for _, sign := range []string{"A", "Z", "a", "z", "0", "9", "-", "_"} {
+		if dir := s.shardDir(sign + "rest"); !dirs[dir] {
+			t.Errorf("shardDir(%q) = %s, not one of the 16 buckets", sign, dir)
+		}
+	}
+
+	if len(dirs) != 16 || !dirs["/sessions/f/"] {
+		t.Errorf("bucket dirs = %v, want /sessions/0/ to /sessions/f/", dirs)
+	}
+}
+
+func getSessionWithError(s *SessionManager, sign string) (map[string]interface{}, error) {
+	return s.GetWithError(httptest.NewRecorder(), requestWithCookie(s.CookieName, sign))
+}
+
+func TestFileEncryption(t *testing.T) {
+	s := newTestManager(t, WithFileEncryption([]byte("key")))
+	setSession(t, s, "sign", map[string]interface{}{"uid": "secret-uid"})
+
+	content, err := os.ReadFile(s.sessionFile("sign"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(content, []byte("secret-uid")) {
+		t.Error("session file contains plaintext")
+	}
+	if _, err := decodeGob(content); err == nil {
+		t.Error("session file decodes as plain Gob")
+	}
+
+	if got, err := getSessionWithError(s, "sign"); err != nil || got["uid"] != "secret-uid" {
+		t.Errorf("GetWithError = %v, %v; want uid secret-uid", got, err)
+	}
+
+	other := New("", "", 3600, s.sessionDir, "1h", WithFileEncryption([]byte("other")))
+	if _, err := getSessionWithError(other, "sign"); err != ErrSessionDecryptionFailed {
+		t.Errorf("GetWithError with wrong key error = %v, want ErrSessionDecryptionFailed", err)
+	}
+}
+
+func TestFileEncryptionLegacy(t *testing.T) {
+	plain := newTestManager(t)
+	setSession(t, plain, "sign", map[string]interface{}{"uid": "1"})
+
+	s := New("", "", 3600, plain.sessionDir, "1h", WithFileEncryption([]byte("key")))
+	if _, err := getSessionWithError(s, "sign"); err != ErrLegacyUnencryptedSession {
+		t.Errorf("GetWithError error = %v, want ErrLegacyUnencryptedSession", err)
+	}
+	if got := getSession(s, "sign"); len(got) != 0 {
+		t.Errorf("Get = %v, want empty", got)
+	}
+
+	if got, err := getSessionWithError(plain, "sign"); err != nil || got["uid"] != "1" {
+		t.Errorf("legacy file was rewritten without migration: %v, %v", got, err)
+	}
+}
+
+func TestFileEncryptionMigration(t *testing.T) {
+	plain := newTestManager(t)
+	setSession(t, plain, "sign", map[string]interface{}{"uid": "1"})
+
+	s := New("", "", 3600, plain.sessionDir, "1h", WithFileEncryption([]byte("key")), WithFileEncryptionMigration())
+	if got, err := getSessionWithError(s, "sign"); err != nil || got["uid"] != "1" {
+		t.Fatalf("GetWithError = %v, %v; want uid 1", got, err)
+	}
+
+	if _, err := getSessionWithError(plain, "sign"); err == nil {
+		t.Error("migrated file still decodes as plain Gob")
+	}
+
+	content, err := os.ReadFile(s.sessionFile("sign"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, legacy, err := s.decodeSession(content); err != nil || legacy {
+		t.Errorf("migrated file decodeSession legacy = %v, %v; want encrypted", legacy, err)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package filesession
+
+import (
+	"os"
+)
+
+func renameFile(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
@@ -0,0 +1,36 @@
+//go:build windows
+// +build windows
+
+package filesession
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const (
+	movefileReplaceExisting = 0x1
+	movefileWriteThrough    = 0x8
+)
+
+var procMoveFileExW = syscall.NewLazyDLL("kernel32.dll").NewProc("MoveFileExW")
+
+// windows下使用MoveFileExW(MOVEFILE_REPLACE_EXISTING)覆盖目标文件
+func renameFile(oldPath, newPath string) error {
+	from, err := syscall.UTF16PtrFromString(oldPath)
+	if err != nil {
+		return err
+	}
+
+	to, err := syscall.UTF16PtrFromString(newPath)
+	if err != nil {
+		return err
+	}
+
+	r, _, err := procMoveFileExW.Call(uintptr(unsafe.Pointer(from)), uintptr(unsafe.Pointer(to)), movefileReplaceExisting|movefileWriteThrough)
+	if r == 0 {
+		return err
+	}
+
+	return nil
+}
@@ -3,12 +3,17 @@ module github.com/haiyiyun/session
 go 1.17
 
 require (
+	github.com/alicebob/miniredis/v2 v2.14.1
 	github.com/garyburd/redigo v1.6.3
 	github.com/haiyiyun/log v0.0.0-20211115100502-be01af77681c
 	github.com/haiyiyun/utils v0.0.0-20220108040900-3f7aeeafa0fe
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 )
 
 require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
 	github.com/haiyiyun/uuid v0.0.0-20211115101403-e9c2d7112f99 // indirect
+	github.com/yuin/gopher-lua v0.0.0-20191220021717-ab39c6098bdb // indirect
 	go.mongodb.org/mongo-driver v1.8.1 // indirect
+	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
 )
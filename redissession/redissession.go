@@ -2,17 +2,20 @@ package redissession
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/gob"
+	"encoding/json"
 	"io"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 	"github.com/haiyiyun/log"
 	"github.com/haiyiyun/utils/help"
-	// "time"
 )
 
 func encodeGob(obj map[string]interface{}) (string, error) {
@@ -41,12 +44,31 @@ type SessionManager struct {
 	CookieName   string
 	CookieDomain string
 	rmutex       sync.RWMutex
-	mutex        sync.Mutex
-	sessions     map[string]interface{}
 	expires      int
+	jsonStorage  bool
+	namespace    string
 }
 
-func New(pool *redis.Pool, cookieName, cookieDomain string, expires int) *SessionManager {
+type Option func(*SessionManager)
+
+// 以JSON代替Gob存储session，便于直接在redis中查看
+// 读取时按内容是否以'{'开头判断格式，已有的Gob格式session仍可读取
+// JSON不保留Go类型：读回的数字均为float64(int存入后读回为float64)，gob.Register注册的自定义类型会变为map[string]interface{}
+func WithJSONStorage() Option {
+	return func(s *SessionManager) {
+		s.jsonStorage = true
+	}
+}
+
+// 所有session的key都加上"ns:"前缀，以便与共享redis中的其他key区分
+// 命名空间可以包含':'(如"app:web")，Len只统计恰好属于ns的session，不包含"ns:子空间:"下的key
+func WithNamespace(ns string) Option {
+	return func(s *SessionManager) {
+		s.namespace = ns
+	}
+}
+
+func New(pool *redis.Pool, cookieName, cookieDomain string, expires int, opts ...Option) *SessionManager {
 	if cookieName == "" {
 		cookieName = "HaiyiyunSession"
 	}
@@ -62,10 +84,64 @@ func New(pool *redis.Pool, cookieName, cookieDomain string, expires int) *Sessio
 		expires:      expires,
 	}
 
+	for _, opt := range opts {
+		opt(s)
+	}
+
 	return s
 }
 
+// 返回写入session时使用的格式："gob"或"json"
+func (s *SessionManager) EncodeFormat() string {
+	if s.jsonStorage {
+		return "json"
+	}
+
+	return "gob"
+}
+
+func (s *SessionManager) key(sessionSign string) string {
+	if s.namespace == "" {
+		return sessionSign
+	}
+
+	return s.namespace + ":" + sessionSign
+}
+
+func (s *SessionManager) encode(session map[string]interface{}) (string, error) {
+	if !s.jsonStorage {
+		return encodeGob(session)
+	}
+
+	b, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func (s *SessionManager) decode(encoded []byte) (map[string]interface{}, error) {
+	if len(encoded) == 0 || encoded[0] != '{' {
+		return decodeGob(encoded)
+	}
+
+	var out map[string]interface{}
+	if err := json.Unmarshal(encoded, &out); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
 func (s *SessionManager) Get(rw http.ResponseWriter, req *http.Request) map[string]interface{} {
+	session, _ := s.GetContext(context.Background(), rw, req)
+	return session
+}
+
+// 与Get相同，但redis操作受ctx的取消和截止时间控制，并返回redis及解码错误
+// ctx没有截止时间时只在发送命令前检查是否已取消，命令发出后的取消不会中断等待
+func (s *SessionManager) GetContext(ctx context.Context, rw http.ResponseWriter, req *http.Request) (map[string]interface{}, error) {
 	var sessionSign string
 
 	s.rmutex.RLock()
@@ -75,34 +151,46 @@ func (s *SessionManager) Get(rw http.ResponseWriter, req *http.Request) map[stri
 	if err == nil {
 		sessionSign = c.Value
 		log.Debug("<GET> ", "sessionSign:", sessionSign)
-		log.Debug("<GET> ", "pool:", s.pool.Get())
-		session_string, err := redis.String(s.pool.Get().Do("GET", sessionSign))
-		if err != nil {
+		session_string, err := redis.String(s.doContext(ctx, "GET", s.key(sessionSign)))
+		if err == redis.ErrNil {
+			log.Debug("<GET> ", "redis_get_nil")
+			return map[string]interface{}{}, nil
+		} else if err != nil {
 			log.Debug("<GET> ", "redis_get_error:", err)
-			return map[string]interface{}{}
+			return map[string]interface{}{}, err
 		}
 		log.Debug("<GET> ", "redis_get_session:", session_string)
-		session, err := decodeGob([]byte(session_string))
+		session, err := s.decode([]byte(session_string))
 		if err != nil {
 			log.Debug("<GET> ", "session_decode_error:", err)
-			return map[string]interface{}{}
+			return map[string]interface{}{}, err
 		}
 		log.Debug("<GET> ", "redis_get_session:", session)
-		return session
+		return session, nil
 
 	}
 	log.Error("<GET> error:", err)
 	log.Debug("<GET> ", "no_cookie_name")
 	s.new(rw)
-	return map[string]interface{}{}
+	return map[string]interface{}{}, nil
 }
 
 func (s *SessionManager) Set(session map[string]interface{}, rw http.ResponseWriter, req *http.Request) {
-	s.SetEX(session, rw, req, s.expires)
+	s.SetContext(context.Background(), session, rw, req)
 }
 
-//设置session和cookie
+func (s *SessionManager) SetContext(ctx context.Context, session map[string]interface{}, rw http.ResponseWriter, req *http.Request) error {
+	return s.SetEXContext(ctx, session, rw, req, s.expires)
+}
+
+// 设置session和cookie
 func (s *SessionManager) SetEX(session map[string]interface{}, rw http.ResponseWriter, req *http.Request, exprie int) {
+	s.SetEXContext(context.Background(), session, rw, req, exprie)
+}
+
+// 与SetEX相同，但redis操作受ctx的取消和截止时间控制，并返回错误
+// ctx没有截止时间时只在发送命令前检查是否已取消，命令发出后的取消不会中断等待
+func (s *SessionManager) SetEXContext(ctx context.Context, session map[string]interface{}, rw http.ResponseWriter, req *http.Request, exprie int) error {
 	s.rmutex.RLock()
 	cookieName := s.CookieName
 	s.rmutex.RUnlock()
@@ -113,21 +201,48 @@ func (s *SessionManager) SetEX(session map[string]interface{}, rw http.ResponseW
 		if lsess == 0 {
 			// s.Clear(sessionSign)
 			help.SetCookie(rw, nil, cookieName, "", -3600)
-			return
+			return nil
 		}
-		session_string, err := encodeGob(session)
+		session_string, err := s.encode(session)
 		if err != nil {
 			log.Debug("<SET> ", "session_encode_error:", err)
-			return
+			return err
 		}
 		log.Debug("<SET> ", "session_encode:", session_string)
-		_, err = s.pool.Get().Do("SETEX", sessionSign, exprie, session_string)
+		_, err = s.doContext(ctx, "SETEX", s.key(sessionSign), exprie, session_string)
 		if err != nil {
 			log.Debug("<SET> ", "session_set_error:", err)
-			return
+			return err
 		}
 	}
+
+	return nil
 }
+
+// 从连接池获取连接并执行命令，ctx有截止时间时以剩余时间作为读超时
+func (s *SessionManager) doContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+
+		return redis.DoWithTimeout(conn, timeout, cmd, args...)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return conn.Do(cmd, args...)
+}
+
 func (s *SessionManager) Clear(rw http.ResponseWriter, req *http.Request) {
 	s.rmutex.RLock()
 	cookieName := s.CookieName
@@ -136,7 +251,9 @@ func (s *SessionManager) Clear(rw http.ResponseWriter, req *http.Request) {
 	if c, err := req.Cookie(cookieName); err == nil {
 		sessionSign := c.Value
 
-		_, err = s.pool.Get().Do("DEL", sessionSign)
+		conn := s.pool.Get()
+		_, err = conn.Do("DEL", s.key(sessionSign))
+		conn.Close()
 		if err != nil {
 			log.Debug("<SET> ", "session_del_error:", err)
 			return
@@ -145,10 +262,119 @@ func (s *SessionManager) Clear(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// 只检查session是否存在，不读取和解码session数据
+func (s *SessionManager) Exists(req *http.Request) (bool, error) {
+	s.rmutex.RLock()
+	cookieName := s.CookieName
+	s.rmutex.RUnlock()
+
+	c, err := req.Cookie(cookieName)
+	if err != nil {
+		return false, nil
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	n, err := redis.Int(conn.Do("EXISTS", s.key(c.Value)))
+	if err != nil {
+		log.Debug("<EXISTS> ", "redis_exists_error:", err)
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+// 只返回keys中指定的session字段
+// session整体存储为一个值(Gob或JSON)，因此仍需读取并解码完整的session后再过滤
+func (s *SessionManager) GetFields(req *http.Request, keys []string) (map[string]interface{}, error) {
+	s.rmutex.RLock()
+	cookieName := s.CookieName
+	s.rmutex.RUnlock()
+
+	fields := map[string]interface{}{}
+	c, err := req.Cookie(cookieName)
+	if err != nil {
+		return fields, nil
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	session_string, err := redis.String(conn.Do("GET", s.key(c.Value)))
+	if err == redis.ErrNil {
+		return fields, nil
+	} else if err != nil {
+		log.Debug("<GETFIELDS> ", "redis_get_error:", err)
+		return fields, err
+	}
+
+	session, err := s.decode([]byte(session_string))
+	if err != nil {
+		log.Debug("<GETFIELDS> ", "session_decode_error:", err)
+		return fields, err
+	}
+
+	for _, key := range keys {
+		if v, ok := session[key]; ok {
+			fields[key] = v
+		}
+	}
+
+	return fields, nil
+}
+
+// 使用SCAN统计命名空间下的session数量
+// session标识为base64不含':'，"ns:"之后仍含':'的key属于嵌套的命名空间，不计入
+// 未设置命名空间时无法区分session与库中的其他key，返回0
 func (s *SessionManager) Len() int64 {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	return int64(len(s.sessions))
+	if s.namespace == "" {
+		return 0
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	var slen int64
+	prefix := s.namespace + ":"
+	cursor := "0"
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", escapeGlob(prefix)+"*", "COUNT", 1000))
+		if err != nil {
+			log.Debug("<LEN> ", "redis_scan_error:", err)
+			return slen
+		}
+
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			log.Debug("<LEN> ", "redis_scan_error:", err)
+			return slen
+		}
+
+		for _, key := range keys {
+			if !strings.Contains(key[len(prefix):], ":") {
+				slen++
+			}
+		}
+
+		if cursor == "0" {
+			return slen
+		}
+	}
+}
+
+// 转义redis MATCH模式中的通配字符，使命名空间按字面匹配
+func escapeGlob(pattern string) string {
+	var b strings.Builder
+	for _, r := range pattern {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
 }
 
 func (s *SessionManager) new(rw http.ResponseWriter) string {
@@ -0,0 +1,284 @@
+package redissession
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/garyburd/redigo/redis"
+)
+
+func newTestManager(t *testing.T, opts ...Option) (*SessionManager, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mr.Close)
+
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", mr.Addr())
+		},
+	}
+	t.Cleanup(func() { pool.Close() })
+
+	return New(pool, "", "", 3600, opts...), mr
+}
+
+func requestWithCookie(name, value string) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	if value != "" {
+		req.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+
+	return req
+}
+
+func TestExists(t *testing.T) {
+	s, _ := newTestManager(t)
+	req := requestWithCookie(s.CookieName, "sign")
+
+	if ok, err := s.Exists(requestWithCookie(s.CookieName, "")); err != nil || ok {
+		t.Errorf("Exists without cookie = %v, %v; want false", ok, err)
+	}
+
+	if ok, err := s.Exists(req); err != nil || ok {
+		t.Errorf("Exists before Set = %v, %v; want false", ok, err)
+	}
+
+	s.Set(map[string]interface{}{"uid": "1"}, httptest.NewRecorder(), req)
+	if ok, err := s.Exists(req); err != nil || !ok {
+		t.Errorf("Exists after Set = %v, %v; want true", ok, err)
+	}
+
+	s.Clear(httptest.NewRecorder(), req)
+	if ok, err := s.Exists(req); err != nil || ok {
+		t.Errorf("Exists after Clear = %v, %v; want false", ok, err)
+	}
+}
+
+func TestGetFields(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"gob", nil},
+		{"json", []Option{WithJSONStorage()}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestManager(t, tt.opts...)
+			req := requestWithCookie(s.CookieName, "sign")
+			s.Set(map[string]interface{}{"uid": "1", "name": "a", "role": "admin"}, httptest.NewRecorder(), req)
+
+			fields, err := s.GetFields(req, []string{"uid", "role", "missing"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(fields) != 2 || fields["uid"] != "1" || fields["role"] != "admin" {
+				t.Errorf("GetFields = %v, want only uid and role", fields)
+			}
+		})
+	}
+}
+
+func TestContextTimeout(t *testing.T) {
+	s, _ := newTestManager(t)
+	req := requestWithCookie(s.CookieName, "sign")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := s.SetContext(ctx, map[string]interface{}{"uid": "1"}, httptest.NewRecorder(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := s.GetContext(ctx, httptest.NewRecorder(), req); err != nil || got["uid"] != "1" {
+		t.Errorf("GetContext = %v, %v; want uid 1", got, err)
+	}
+}
+
+func TestContextTimeoutUnresponsiveServer(t *testing.T) {
+	// 接受连接但从不回复的服务器
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", ln.Addr().String())
+		},
+	}
+	defer pool.Close()
+
+	s := New(pool, "", "", 3600)
+	req := requestWithCookie(s.CookieName, "sign")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := s.GetContext(ctx, httptest.NewRecorder(), req); err == nil {
+		t.Error("GetContext succeeded against an unresponsive server")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("GetContext took %v, want about 50ms", d)
+	}
+
+	if err := s.SetContext(ctx, map[string]interface{}{"uid": "1"}, httptest.NewRecorder(), req); err != context.DeadlineExceeded {
+		t.Errorf("SetContext after deadline error = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestContextCancelled(t *testing.T) {
+	s, _ := newTestManager(t)
+	req := requestWithCookie(s.CookieName, "sign")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := s.GetContext(ctx, httptest.NewRecorder(), req); err != context.Canceled {
+		t.Errorf("GetContext error = %v, want context.Canceled", err)
+	}
+}
+
+func TestJSONStorage(t *testing.T) {
+	s, mr := newTestManager(t, WithJSONStorage(), WithNamespace("app"))
+	req := requestWithCookie(s.CookieName, "sign")
+	s.Set(map[string]interface{}{"uid": "1", "count": 2}, httptest.NewRecorder(), req)
+
+	stored, err := mr.Get("app:sign")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(stored), &raw); err != nil {
+		t.Fatalf("stored session is not JSON: %v", err)
+	}
+	if raw["uid"] != "1" || raw["count"] != float64(2) {
+		t.Errorf("stored session = %v, want uid 1 and count 2", raw)
+	}
+
+	if got := s.Get(httptest.NewRecorder(), req); got["count"] != float64(2) {
+		t.Errorf("Get count = %#v, want float64(2)", got["count"])
+	}
+}
+
+func TestJSONStorageReadsGob(t *testing.T) {
+	gobManager, mr := newTestManager(t)
+	req := requestWithCookie(gobManager.CookieName, "sign")
+	gobManager.Set(map[string]interface{}{"count": 2}, httptest.NewRecorder(), req)
+
+	s := New(gobManager.pool, "", "", 3600, WithJSONStorage())
+	if got := s.Get(httptest.NewRecorder(), req); got["count"] != 2 {
+		t.Errorf("Get of Gob session = %v, want count 2", got)
+	}
+
+	stored, _ := mr.Get("sign")
+	if json.Valid([]byte(stored)) {
+		t.Error("Gob session stored as JSON")
+	}
+}
+
+func TestLenNamespaces(t *testing.T) {
+	a, mr := newTestManager(t, WithNamespace("a*"))
+	b := New(a.pool, "", "", 3600, WithNamespace("ab"))
+	none := New(a.pool, "", "", 3600)
+
+	for i, s := range []*SessionManager{a, a, b, b, b} {
+		req := requestWithCookie(s.CookieName, "sign"+string(rune('0'+i)))
+		s.Set(map[string]interface{}{"uid": i}, httptest.NewRecorder(), req)
+	}
+	mr.Set("unrelated", "x")
+
+	if n := a.Len(); n != 2 {
+		t.Errorf("Len of a* = %d, want 2", n)
+	}
+
+	if n := b.Len(); n != 3 {
+		t.Errorf("Len of ab = %d, want 3", n)
+	}
+
+	if n := none.Len(); n != 0 {
+		t.Errorf("Len without namespace = %d, want 0", n)
+	}
+}
+
+func TestNestedNamespaceLen(t *testing.T) {
+	a, _ := newTestManager(t, WithNamespace("a"))
+	nested := New(a.pool, "", "", 3600, WithNamespace("a:b"))
+
+	a.Set(map[string]interface{}{"uid": "1"}, httptest.NewRecorder(), requestWithCookie(a.CookieName, "sign"))
+	for _, sign := range []string{"sign", "other"} {
+		nested.Set(map[string]interface{}{"uid": "2"}, httptest.NewRecorder(), requestWithCookie(nested.CookieName, sign))
+	}
+
+	if n := a.Len(); n != 1 {
+		t.Errorf("Len of a = %d, want 1", n)
+	}
+
+	if n := nested.Len(); n != 2 {
+		t.Errorf("Len of a:b = %d, want 2", n)
+	}
+}
+
+func TestNamespaceIsolation(t *testing.T) {
+	a, _ := newTestManager(t, WithNamespace("a"))
+	b := New(a.pool, "", "", 3600, WithNamespace("b"))
+	req := requestWithCookie(a.CookieName, "sign")
+
+	a.Set(map[string]interface{}{"uid": "1"}, httptest.NewRecorder(), req)
+
+	if got := b.Get(httptest.NewRecorder(), req); len(got) != 0 {
+		t.Errorf("b.Get = %v, want a's session hidden", got)
+	}
+
+	if ok, err := b.Exists(req); err != nil || ok {
+		t.Errorf("b.Exists = %v, %v; want false", ok, err)
+	}
+
+	if got := a.Get(httptest.NewRecorder(), req); got["uid"] != "1" {
+		t.Errorf("a.Get = %v, want uid 1", got)
+	}
+
+	b.Set(map[string]interface{}{"uid": "2"}, httptest.NewRecorder(), req)
+	if got := a.Get(httptest.NewRecorder(), req); got["uid"] != "1" {
+		t.Errorf("a.Get after b.Set = %v, want uid 1", got)
+	}
+}
+
+func TestEscapeGlob(t *testing.T) {
+	tests := map[string]string{
+		"app":   "app",
+		"a*":    `a\*`,
+		"a?[b]": `a\?\[b\]`,
+		`a\b`:   `a\\b`,
+	}
+
+	for in, want := range tests {
+		if got := escapeGlob(in); got != want {
+			t.Errorf("escapeGlob(%q) = %q, want %q", in, got, want)
+		}
+	}
+}